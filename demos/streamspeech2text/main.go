@@ -21,68 +21,241 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	speech "cloud.google.com/go/speech/apiv1"
+	mediatranslation "cloud.google.com/go/mediatranslation/apiv1beta1"
+	speech "cloud.google.com/go/speech/apiv2"
+	speechpb "cloud.google.com/go/speech/apiv2/speechpb"
 	texttospeech "cloud.google.com/go/texttospeech/apiv1"
 	"cloud.google.com/go/translate"
 	"golang.org/x/text/language"
-	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	mediatranslationpb "google.golang.org/genproto/googleapis/cloud/mediatranslation/v1beta1"
 	texttospeechpb "google.golang.org/genproto/googleapis/cloud/texttospeech/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
 )
 
+// streamingLimit is the maximum duration the Speech-to-Text v2
+// StreamingRecognize API keeps a single stream open before closing it
+// server-side. A session is re-established before this cap is hit so
+// translation never stalls mid-utterance.
+const streamingLimit = 305 * time.Second
+
+// reconnectMargin is how long before streamingLimit a session is
+// proactively re-established.
+const reconnectMargin = 10 * time.Second
+
+// replayBuffer is how many recently sent audio chunks are kept in memory
+// so they can be resent to a freshly (re)established stream: audio sent
+// just before a stream closes may not have produced a result yet.
+const replayBuffer = 32
+
 var (
 	speechClient *speech.Client
 )
 
-func setupSpeechStream(ctx context.Context) (speechpb.Speech_StreamingRecognizeClient, error) {
-	speechClient, err := speech.NewClient(ctx)
-	if err != nil {
-		return nil, err
+// RecognizerConfig identifies the v2 recognizer resource to stream against
+// and the recognition options it was created with.
+type RecognizerConfig struct {
+	// Recognizer is the full resource name of the recognizer, e.g.
+	// "projects/my-project/locations/global/recognizers/my-recognizer", or
+	// "_" to use the implicit default recognizer for the project/location.
+	Recognizer string
+	// Model is the recognition model, e.g. "latest_long" or "telephony".
+	Model string
+	// LanguageCode is the language being spoken, e.g. "en-US".
+	LanguageCode string
+	// AdaptationPhrases biases recognition towards domain-specific terms.
+	AdaptationPhrases []string
+}
+
+func streamingConfigRequest(cfg RecognizerConfig) *speechpb.StreamingRecognizeRequest {
+	recognitionConfig := &speechpb.RecognitionConfig{
+		DecodingConfig: &speechpb.RecognitionConfig_ExplicitDecodingConfig{
+			ExplicitDecodingConfig: &speechpb.ExplicitDecodingConfig{
+				Encoding:          speechpb.ExplicitDecodingConfig_LINEAR16,
+				SampleRateHertz:   16000,
+				AudioChannelCount: 1,
+			},
+		},
+		Model:         cfg.Model,
+		LanguageCodes: []string{cfg.LanguageCode},
+		Features: &speechpb.RecognitionFeatures{
+			EnableAutomaticPunctuation: true,
+		},
 	}
-	stream, err := speechClient.StreamingRecognize(ctx)
-	if err != nil {
-		return nil, err
+	if len(cfg.AdaptationPhrases) > 0 {
+		phrases := make([]*speechpb.PhraseSet_Phrase, len(cfg.AdaptationPhrases))
+		for i, p := range cfg.AdaptationPhrases {
+			phrases[i] = &speechpb.PhraseSet_Phrase{Value: p}
+		}
+		recognitionConfig.Adaptation = &speechpb.SpeechAdaptation{
+			PhraseSets: []*speechpb.SpeechAdaptation_AdaptationPhraseSet{
+				{
+					Value: &speechpb.SpeechAdaptation_AdaptationPhraseSet_InlinePhraseSet{
+						InlinePhraseSet: &speechpb.PhraseSet{Phrases: phrases},
+					},
+				},
+			},
+		}
 	}
-	// Send the initial configuration message.
-	err = stream.Send(&speechpb.StreamingRecognizeRequest{
+
+	return &speechpb.StreamingRecognizeRequest{
+		Recognizer: cfg.Recognizer,
 		StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{
 			StreamingConfig: &speechpb.StreamingRecognitionConfig{
-				Config: &speechpb.RecognitionConfig{
-					Encoding:                   speechpb.RecognitionConfig_LINEAR16,
-					SampleRateHertz:            16000,
-					LanguageCode:               "en-US",
-					EnableAutomaticPunctuation: true,
+				Config: recognitionConfig,
+				StreamingFeatures: &speechpb.StreamingRecognitionFeatures{
+					InterimResults: true,
 				},
 			},
 		},
+	}
+}
+
+func setupSpeechStream(ctx context.Context, cfg RecognizerConfig) (speechpb.Speech_StreamingRecognizeClient, error) {
+	stream, err := speechClient.StreamingRecognize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(streamingConfigRequest(cfg)); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// streamHandle pairs a stream with the generation it was created in, so a
+// caller that was blocked in Recv() on a superseded stream can tell, once
+// Recv() returns, whether it was actually cancelled out from under it.
+type streamHandle struct {
+	stream     speechpb.Speech_StreamingRecognizeClient
+	generation int
+}
+
+// speechSession owns the current StreamingRecognize stream and transparently
+// swaps it out for a new one on reconnect, replaying any audio the previous
+// stream may not have acknowledged yet. Each stream is opened on its own
+// cancellable context so a superseded stream's blocking Recv() can be woken
+// up immediately instead of waiting for the server to close it.
+type speechSession struct {
+	cfg       RecognizerConfig
+	parentCtx context.Context
+
+	mu         sync.Mutex
+	stream     speechpb.Speech_StreamingRecognizeClient
+	cancel     context.CancelFunc
+	generation int
+	recent     [][]byte
+}
+
+func newSpeechSession(ctx context.Context, cfg RecognizerConfig) (*speechSession, error) {
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := setupSpeechStream(streamCtx, cfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &speechSession{cfg: cfg, parentCtx: ctx, stream: stream, cancel: cancel}, nil
+}
+
+func (s *speechSession) current() streamHandle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return streamHandle{stream: s.stream, generation: s.generation}
+}
+
+func (s *speechSession) send(chunk []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = append(s.recent, chunk)
+	if len(s.recent) > replayBuffer {
+		s.recent = s.recent[1:]
+	}
+	return s.stream.Send(&speechpb.StreamingRecognizeRequest{
+		StreamingRequest: &speechpb.StreamingRecognizeRequest_Audio{Audio: chunk},
 	})
+}
 
-	return stream, err
+// reconnect opens a fresh StreamingRecognize session, either because the
+// 305s cap is about to be hit or because the previous stream was closed
+// with the "exceeded limit" error, and replays the buffered audio so the
+// switchover doesn't drop any of the current utterance. It cancels the
+// superseded stream's context so a goroutine blocked in Recv() on it wakes
+// up right away instead of only noticing the swap once the server
+// independently tears the old stream down.
+func (s *speechSession) reconnect() error {
+	streamCtx, cancel := context.WithCancel(s.parentCtx)
+	next, err := setupSpeechStream(streamCtx, s.cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s.mu.Lock()
+	buffered := s.recent
+	oldCancel := s.cancel
+	s.stream = next
+	s.cancel = cancel
+	s.generation++
+	s.recent = nil
+	s.mu.Unlock()
+
+	oldCancel()
+
+	for _, chunk := range buffered {
+		if err := s.send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isStreamLimitError(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.OutOfRange, codes.Unknown, codes.Aborted:
+		// Workaround while the API doesn't give a more informative error:
+		// these codes are how a stream closed for exceeding its time limit
+		// has historically surfaced.
+		return true
+	}
+	return false
 }
 
-func startListeningStdin(stream speechpb.Speech_StreamingRecognizeClient) {
-	// Pipe stdin to the API.
+func startListeningStdin(audio chan []byte) {
+	// Pipe stdin to the audio channel.
 	buf := make([]byte, 1024)
 	for {
 		n, err := os.Stdin.Read(buf)
-		if err := stream.Send(&speechpb.StreamingRecognizeRequest{
-			StreamingRequest: &speechpb.StreamingRecognizeRequest_AudioContent{
-				AudioContent: buf[:n],
-			},
-		}); err != nil {
-			log.Printf("Could not send audio: %v", err)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			audio <- chunk
 		}
 		if err == io.EOF {
-			// Nothing else to pipe, close the stream.
-			if err := stream.CloseSend(); err != nil {
-				log.Fatalf("Could not close stream: %v", err)
-			}
+			close(audio)
 			return
 		}
 		if err != nil {
@@ -92,26 +265,314 @@ func startListeningStdin(stream speechpb.Speech_StreamingRecognizeClient) {
 	}
 }
 
-func startReceivingStream(stream speechpb.Speech_StreamingRecognizeClient,
+// bufferedAudio sits between a fan-out loop and one consumer, absorbing
+// chunks into a growable queue instead of blocking the sender when that
+// consumer falls behind. Without it, a single slow consumer on a shared
+// fan-out loop would backpressure every other consumer fed by the same
+// loop.
+func bufferedAudio(in chan []byte) chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		var queue [][]byte
+		for in != nil || len(queue) > 0 {
+			if len(queue) == 0 {
+				chunk, ok := <-in
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, chunk)
+				continue
+			}
+			select {
+			case chunk, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, chunk)
+			case out <- queue[0]:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
+
+// teeAudio duplicates chunks read from stdin to n independent consumers,
+// e.g. one path streaming audio to the recognizer while another runs a
+// local VAD pass over the same samples, or one path per target language's
+// Media Translation session. Each consumer is decoupled by bufferedAudio
+// so a slow one only delays itself.
+func teeAudio(in chan []byte, n int) []chan []byte {
+	raw := make([]chan []byte, n)
+	for i := range raw {
+		raw[i] = make(chan []byte)
+	}
+	go func() {
+		defer func() {
+			for _, out := range raw {
+				close(out)
+			}
+		}()
+		for chunk := range in {
+			for _, out := range raw {
+				out <- chunk
+			}
+		}
+	}()
+
+	outs := make([]chan []byte, n)
+	for i, r := range raw {
+		outs[i] = bufferedAudio(r)
+	}
+	return outs
+}
+
+const (
+	// vadFrameDuration is the analysis window for the energy-based VAD.
+	vadFrameDuration = 20 * time.Millisecond
+	// vadSilenceDuration of consecutive unvoiced frames closes an utterance.
+	vadSilenceDuration = 500 * time.Millisecond
+	// vadMedianWindow is how many past unvoiced frames the noise floor is
+	// estimated from.
+	vadMedianWindow = 50
+	// vadFrameBytes is the number of LINEAR16 bytes in one vadFrameDuration
+	// frame at the 16kHz mono rate this tool captures audio at.
+	vadFrameBytes = 2 * 16000 * int(vadFrameDuration/time.Millisecond) / 1000
+)
+
+// detectUtteranceBoundaries runs a simple energy-based VAD over raw
+// LINEAR16 audio and signals once per utterance: after vadSilenceDuration
+// of consecutive unvoiced frames that followed at least one voiced frame.
+// It's used to segment utterances when the streaming API's own
+// END_OF_SINGLE_UTTERANCE event isn't available.
+func detectUtteranceBoundaries(audio chan []byte, noiseMultiplier float64) chan struct{} {
+	boundaries := make(chan struct{})
+	silenceFrames := int(vadSilenceDuration / vadFrameDuration)
+
+	go func() {
+		defer close(boundaries)
+
+		var noiseFloor []float64
+		voicedSinceBoundary := false
+		unvoicedRun := 0
+		var pending []byte
+
+		for chunk := range audio {
+			frames, rest := splitFrames(append(pending, chunk...))
+			pending = append([]byte(nil), rest...)
+			for _, frame := range frames {
+				rms := rmsOf(frame)
+				threshold := median(noiseFloor) * noiseMultiplier
+				voiced := len(noiseFloor) == vadMedianWindow && rms > threshold
+
+				if voiced {
+					voicedSinceBoundary = true
+					unvoicedRun = 0
+				} else {
+					unvoicedRun++
+					noiseFloor = append(noiseFloor, rms)
+					if len(noiseFloor) > vadMedianWindow {
+						noiseFloor = noiseFloor[1:]
+					}
+				}
+
+				if voicedSinceBoundary && unvoicedRun == silenceFrames {
+					boundaries <- struct{}{}
+					voicedSinceBoundary = false
+				}
+			}
+		}
+	}()
+
+	return boundaries
+}
+
+// splitFrames cuts buf into whole vadFrameBytes frames and returns the
+// leftover bytes separately, to be completed by the next chunk.
+func splitFrames(buf []byte) (frames [][]byte, rest []byte) {
+	for len(buf) >= vadFrameBytes {
+		frames = append(frames, buf[:vadFrameBytes])
+		buf = buf[vadFrameBytes:]
+	}
+	return frames, buf
+}
+
+func rmsOf(frame []byte) float64 {
+	samples := len(frame) / 2
+	if samples == 0 {
+		return 0
+	}
+	var sumSquares float64
+	for i := 0; i < samples; i++ {
+		sample := float64(int16(binary.LittleEndian.Uint16(frame[i*2 : i*2+2])))
+		sumSquares += sample * sample
+	}
+	return math.Sqrt(sumSquares / float64(samples))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// segmentUtterances forwards only the most recently seen alternative each
+// time a VAD boundary fires, rather than every interim/final result, so one
+// translation+TTS request is issued per utterance instead of per result.
+func segmentUtterances(alts chan *speechpb.SpeechRecognitionAlternative, boundaries chan struct{}) chan *speechpb.SpeechRecognitionAlternative {
+	out := make(chan *speechpb.SpeechRecognitionAlternative)
+	go func() {
+		defer close(out)
+		var latest *speechpb.SpeechRecognitionAlternative
+		for {
+			select {
+			case alt, ok := <-alts:
+				if !ok {
+					return
+				}
+				latest = alt
+			case _, ok := <-boundaries:
+				if !ok {
+					return
+				}
+				if latest != nil {
+					out <- latest
+					latest = nil
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// bufferedAlts is the *speechpb.SpeechRecognitionAlternative counterpart of
+// bufferedAudio: it decouples a consumer from the fan-out loop so a slow
+// target language's translate+speak pipeline can't backpressure the
+// others.
+func bufferedAlts(in chan *speechpb.SpeechRecognitionAlternative) chan *speechpb.SpeechRecognitionAlternative {
+	out := make(chan *speechpb.SpeechRecognitionAlternative)
+	go func() {
+		defer close(out)
+		var queue []*speechpb.SpeechRecognitionAlternative
+		for in != nil || len(queue) > 0 {
+			if len(queue) == 0 {
+				alt, ok := <-in
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, alt)
+				continue
+			}
+			select {
+			case alt, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, alt)
+			case out <- queue[0]:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
+
+// fanOutAlts duplicates each segmented utterance to n independent
+// consumers, so every target language gets its own translate+speak
+// pipeline fed from the same recognition stream. Each consumer is
+// decoupled by bufferedAlts so a slow one only delays itself.
+func fanOutAlts(in chan *speechpb.SpeechRecognitionAlternative, n int) []chan *speechpb.SpeechRecognitionAlternative {
+	raw := make([]chan *speechpb.SpeechRecognitionAlternative, n)
+	for i := range raw {
+		raw[i] = make(chan *speechpb.SpeechRecognitionAlternative)
+	}
+	go func() {
+		defer func() {
+			for _, out := range raw {
+				close(out)
+			}
+		}()
+		for alt := range in {
+			for _, out := range raw {
+				out <- alt
+			}
+		}
+	}()
+
+	outs := make([]chan *speechpb.SpeechRecognitionAlternative, n)
+	for i, r := range raw {
+		outs[i] = bufferedAlts(r)
+	}
+	return outs
+}
+
+func startReceivingStream(ctx context.Context, cfg RecognizerConfig, audio chan []byte,
 	alts chan *speechpb.SpeechRecognitionAlternative) {
+	session, err := newSpeechSession(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Could not open stream: %v", err)
+	}
+
+	go func() {
+		timer := time.NewTimer(streamingLimit - reconnectMargin)
+		defer timer.Stop()
+		for {
+			select {
+			case chunk, ok := <-audio:
+				if !ok {
+					session.current().stream.CloseSend()
+					return
+				}
+				if err := session.send(chunk); err != nil {
+					log.Printf("Could not send audio: %v", err)
+				}
+			case <-timer.C:
+				log.Print("Re-establishing streaming recognize session before the 305s cap.")
+				if err := session.reconnect(); err != nil {
+					log.Fatalf("Could not reconnect stream: %v", err)
+				}
+				timer.Reset(streamingLimit - reconnectMargin)
+			}
+		}
+	}()
+
 	for {
-		resp, err := stream.Recv()
+		handle := session.current()
+		resp, err := handle.stream.Recv()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatalf("Cannot stream results: %v", err)
-		}
-		if err := resp.Error; err != nil {
-			// Workaround while the API doesn't give a more informative error.
-			if err.Code == 3 || err.Code == 11 {
-				log.Print("WARNING: Speech recognition request exceeded limit of 60 seconds.")
+			if handle.generation != session.current().generation {
+				// This stream was superseded by a proactive reconnect, which
+				// cancelled it to unblock this Recv() call. The new stream
+				// is already in place, so just pick it up on the next loop
+				// instead of treating the cancellation as a failure.
+				continue
 			}
-			log.Fatalf("Could not recognize: %v", err)
+			if isStreamLimitError(err) {
+				log.Print("WARNING: streaming recognize request exceeded limit, reconnecting.")
+				if err := session.reconnect(); err != nil {
+					log.Fatalf("Could not reconnect stream: %v", err)
+				}
+				continue
+			}
+			log.Fatalf("Cannot stream results: %v", err)
 		}
-		for _, result := range resp.Results {
-			alternatives := result.GetAlternatives()
-			for _, alt := range alternatives {
+		for _, result := range resp.GetResults() {
+			for _, alt := range result.GetAlternatives() {
 				fmt.Println("Transcript alternatives: ", alt.Transcript)
 				alts <- alt
 			}
@@ -119,20 +580,140 @@ func startReceivingStream(stream speechpb.Speech_StreamingRecognizeClient,
 	}
 }
 
+// startMediaTranslating fuses recognition and translation into a single
+// bi-directional StreamingTranslateSpeech call against the Media
+// Translation API. It expects 16kHz LINEAR16 audio on the audio channel and
+// prints partial and final translated text as it arrives; the latest
+// translation is sent on texts only when the API reports an
+// END_OF_SINGLE_UTTERANCE speech event, so partial results are not sent.
+func startMediaTranslating(ctx context.Context, audio chan []byte, source, target string, texts chan string) {
+	client, err := mediatranslation.NewSpeechTranslationClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create media translation client: %v", err)
+	}
+
+	stream, err := client.StreamingTranslateSpeech(ctx)
+	if err != nil {
+		log.Fatalf("Failed to open media translation stream: %v", err)
+	}
+
+	err = stream.Send(&mediatranslationpb.StreamingTranslateSpeechRequest{
+		StreamingRequest: &mediatranslationpb.StreamingTranslateSpeechRequest_StreamingConfig{
+			StreamingConfig: &mediatranslationpb.StreamingTranslateSpeechConfig{
+				AudioConfig: &mediatranslationpb.TranslateSpeechConfig{
+					AudioEncoding:      "linear16",
+					SourceLanguageCode: source,
+					TargetLanguageCode: target,
+					SampleRateHertz:    16000,
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("Could not send streaming config: %v", err)
+	}
+
+	go func() {
+		for chunk := range audio {
+			err := stream.Send(&mediatranslationpb.StreamingTranslateSpeechRequest{
+				StreamingRequest: &mediatranslationpb.StreamingTranslateSpeechRequest_AudioContent{
+					AudioContent: chunk,
+				},
+			})
+			if err != nil {
+				log.Printf("Could not send audio: %v", err)
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	var utterance string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Cannot stream translation results: %v", err)
+		}
+
+		if result := resp.GetResult(); result != nil {
+			if t := result.GetTextTranslationResult(); t != nil {
+				utterance = t.GetTranslation()
+				fmt.Println("Translation: ", utterance)
+			}
+		}
+		if resp.GetSpeechEventType() == mediatranslationpb.StreamingTranslateSpeechResponse_END_OF_SINGLE_UTTERANCE && utterance != "" {
+			texts <- utterance
+			utterance = ""
+		}
+	}
+}
+
 func main() {
 	ctx := context.Background()
 
-	stream, err := setupSpeechStream(ctx)
-	if err != nil {
-		panic(err)
+	engine := flag.String("engine", "speech+translate", `translation pipeline to use: "speech+translate" (Speech-to-Text + Cloud Translate + chained TTS) or "media-translation" (single Media Translation streaming call)`)
+	source := flag.String("source", "en-US", "source language code: the recognizer's spoken language for speech+translate, or the source audio language for media-translation")
+	targets := flag.String("targets", "pt-BR", "comma-separated target languages to translate and speak, e.g. pt-BR,es-ES,ja-JP")
+	sink := flag.String("sink", "play", `where synthesized audio goes: "play" (live playback), "file" (rotating output-<lang>-NNNN.mp3 files) or "stdout" (raw LINEAR16 for chaining)`)
+	voicesFile := flag.String("voices", "", "path to a YAML or JSON file listing VoiceSelectionParams per target language")
+	vadMultiplier := flag.Float64("vad-multiplier", 1.5, "how far above the running noise floor a frame's RMS must be to count as voiced")
+	flag.Parse()
+
+	langs := strings.Split(*targets, ",")
+	for i, lang := range langs {
+		langs[i] = strings.TrimSpace(lang)
 	}
-	alts := make(chan *speechpb.SpeechRecognitionAlternative)
-	texts := make(chan string)
 
-	go startListeningStdin(stream)
-	go startReceivingStream(stream, alts)
-	go startTranslating(alts, "pt-BR", texts)
-	go startSpeaking(texts, "pt-BR")
+	voiceConfigs := map[string]VoiceConfig{}
+	if *voicesFile != "" {
+		configs, err := loadVoiceConfigs(*voicesFile)
+		if err != nil {
+			log.Fatalf("Could not load voice config %q: %v", *voicesFile, err)
+		}
+		voiceConfigs = configs
+	}
+	cache := newAudioCache(".audio-cache")
+
+	audio := make(chan []byte)
+	go startListeningStdin(audio)
+
+	switch *engine {
+	case "media-translation":
+		audioPerTarget := teeAudio(audio, len(langs))
+		for i, lang := range langs {
+			texts := make(chan string)
+			go startMediaTranslating(ctx, audioPerTarget[i], *source, lang, texts)
+			go startSpeaking(texts, voiceConfigForLang(voiceConfigs, lang), cache, newAudioSink(*sink, lang))
+		}
+	case "speech+translate":
+		client, err := speech.NewClient(ctx)
+		if err != nil {
+			panic(err)
+		}
+		speechClient = client
+
+		cfg := RecognizerConfig{
+			Recognizer:   "_",
+			Model:        "latest_long",
+			LanguageCode: *source,
+		}
+		split := teeAudio(audio, 2)
+		recognizeAudio, vadAudio := split[0], split[1]
+		alts := make(chan *speechpb.SpeechRecognitionAlternative)
+
+		go startReceivingStream(ctx, cfg, recognizeAudio, alts)
+		utterances := segmentUtterances(alts, detectUtteranceBoundaries(vadAudio, *vadMultiplier))
+		fanned := fanOutAlts(utterances, len(langs))
+		for i, lang := range langs {
+			texts := make(chan string)
+			go startTranslating(fanned[i], lang, texts)
+			go startSpeaking(texts, voiceConfigForLang(voiceConfigs, lang), cache, newAudioSink(*sink, lang))
+		}
+	default:
+		log.Fatalf(`unknown --engine %q: want "speech+translate" or "media-translation"`, *engine)
+	}
 
 	wait := make(chan interface{})
 	<-wait
@@ -142,7 +723,11 @@ func startTranslating(alts chan *speechpb.SpeechRecognitionAlternative, code str
 	ctx := context.Background()
 
 	for {
-		text := (<-alts).Transcript
+		alt, ok := <-alts
+		if !ok {
+			return
+		}
+		text := alt.Transcript
 		// Creates a client.
 		client, err := translate.NewClient(ctx)
 		if err != nil {
@@ -166,7 +751,162 @@ func startTranslating(alts chan *speechpb.SpeechRecognitionAlternative, code str
 	}
 }
 
-func startSpeaking(texts chan string, lang string) {
+// VoiceConfig describes the Text-to-Speech voice to use for one target
+// language, as loaded from the --voices config file.
+type VoiceConfig struct {
+	Language     string  `json:"language" yaml:"language"`
+	Name         string  `json:"name" yaml:"name"`
+	Gender       string  `json:"gender" yaml:"gender"`
+	SpeakingRate float64 `json:"speakingRate" yaml:"speakingRate"`
+	Pitch        float64 `json:"pitch" yaml:"pitch"`
+}
+
+// loadVoiceConfigs reads a list of VoiceConfig from a YAML or JSON file
+// (selected by extension) and indexes it by language code.
+func loadVoiceConfigs(path string) (map[string]VoiceConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []VoiceConfig
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, &configs)
+	} else {
+		err = yaml.Unmarshal(data, &configs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byLanguage := make(map[string]VoiceConfig, len(configs))
+	for _, c := range configs {
+		byLanguage[c.Language] = c
+	}
+	return byLanguage, nil
+}
+
+func voiceConfigForLang(configs map[string]VoiceConfig, lang string) VoiceConfig {
+	if voice, ok := configs[lang]; ok {
+		return voice
+	}
+	return VoiceConfig{Language: lang}
+}
+
+func voiceSelectionParams(voice VoiceConfig) *texttospeechpb.VoiceSelectionParams {
+	params := &texttospeechpb.VoiceSelectionParams{
+		LanguageCode: voice.Language,
+		Name:         voice.Name,
+		SsmlGender:   texttospeechpb.SsmlVoiceGender_NEUTRAL,
+	}
+	switch strings.ToUpper(voice.Gender) {
+	case "MALE":
+		params.SsmlGender = texttospeechpb.SsmlVoiceGender_MALE
+	case "FEMALE":
+		params.SsmlGender = texttospeechpb.SsmlVoiceGender_FEMALE
+	}
+	return params
+}
+
+// audioCache stores synthesized speech on disk keyed by an MD5 hash of the
+// text and voice parameters that produced it, so repeated phrases (common
+// in live captioning) skip the Text-to-Speech round trip entirely.
+type audioCache struct {
+	dir string
+}
+
+func newAudioCache(dir string) *audioCache {
+	os.MkdirAll(dir, 0755)
+	return &audioCache{dir: dir}
+}
+
+// cacheExtension picks a file extension that matches the cached bytes so a
+// stale file from a previous --sink=stdout (raw LINEAR16) or
+// --sink=file/play (MP3) run is never mistaken for the other.
+func cacheExtension(encoding texttospeechpb.AudioEncoding) string {
+	if encoding == texttospeechpb.AudioEncoding_LINEAR16 {
+		return ".raw"
+	}
+	return ".mp3"
+}
+
+func (c *audioCache) key(text string, voice VoiceConfig, encoding texttospeechpb.AudioEncoding) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%s|%s|%s|%s|%.2f|%.2f|%d", text, voice.Language, voice.Name, strings.ToUpper(voice.Gender), voice.SpeakingRate, voice.Pitch, encoding)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *audioCache) get(text string, voice VoiceConfig, encoding texttospeechpb.AudioEncoding) ([]byte, bool) {
+	audio, err := ioutil.ReadFile(filepath.Join(c.dir, c.key(text, voice, encoding)+cacheExtension(encoding)))
+	if err != nil {
+		return nil, false
+	}
+	return audio, true
+}
+
+func (c *audioCache) put(text string, voice VoiceConfig, encoding texttospeechpb.AudioEncoding, audio []byte) error {
+	return ioutil.WriteFile(filepath.Join(c.dir, c.key(text, voice, encoding)+cacheExtension(encoding)), audio, 0644)
+}
+
+// AudioSink receives each clip of synthesized speech and is responsible for
+// getting it to the user, whether that's a file, local playback, or
+// another process downstream.
+type AudioSink interface {
+	Write(audio []byte) error
+}
+
+// fileRotationSink writes each clip to its own numbered, language-tagged
+// file instead of clobbering a single output.mp3 on every synthesis.
+type fileRotationSink struct {
+	lang string
+	seq  int
+}
+
+func (s *fileRotationSink) Write(audio []byte) error {
+	filename := fmt.Sprintf("output-%s-%04d.mp3", s.lang, s.seq)
+	s.seq++
+	if err := ioutil.WriteFile(filename, audio, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Audio content written to file: %v\n", filename)
+	return nil
+}
+
+// playbackSink plays each clip as it arrives by piping it into a
+// gst-launch-1.0 process, mirroring the gst-launch invocation used to
+// capture the mic input in the package doc comment above.
+type playbackSink struct{}
+
+func (playbackSink) Write(audio []byte) error {
+	cmd := exec.Command("gst-launch-1.0", "-q", "fdsrc", "fd=0", "!", "decodebin", "!", "autoaudiosink")
+	cmd.Stdin = bytes.NewReader(audio)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// stdoutSink streams raw audio on stdout so it can be chained into another
+// process, e.g. a further gst-launch-1.0 pipeline.
+type stdoutSink struct{}
+
+func (stdoutSink) Write(audio []byte) error {
+	_, err := os.Stdout.Write(audio)
+	return err
+}
+
+func newAudioSink(name, lang string) AudioSink {
+	switch name {
+	case "file":
+		return &fileRotationSink{lang: lang}
+	case "play":
+		return playbackSink{}
+	case "stdout":
+		return stdoutSink{}
+	default:
+		log.Fatalf(`unknown --sink %q: want "file", "play" or "stdout"`, name)
+		return nil
+	}
+}
+
+func startSpeaking(texts chan string, voice VoiceConfig, cache *audioCache, sink AudioSink) {
 	// Instantiates a client.
 	ctx := context.Background()
 
@@ -174,9 +914,25 @@ func startSpeaking(texts chan string, lang string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Playback and file sinks expect a decodable container; the stdout
+	// sink is meant for chaining into another pipeline, so ask for raw
+	// samples instead.
+	encoding := texttospeechpb.AudioEncoding_MP3
+	if _, raw := sink.(stdoutSink); raw {
+		encoding = texttospeechpb.AudioEncoding_LINEAR16
+	}
+
 	for {
 		text := <-texts
 
+		if audio, ok := cache.get(text, voice, encoding); ok {
+			if err := sink.Write(audio); err != nil {
+				log.Printf("Could not write cached audio: %v", err)
+			}
+			continue
+		}
+
 		// Perform the text-to-speech request on the text input with the selected
 		// voice parameters and audio file type.
 		req := texttospeechpb.SynthesizeSpeechRequest{
@@ -184,15 +940,11 @@ func startSpeaking(texts chan string, lang string) {
 			Input: &texttospeechpb.SynthesisInput{
 				InputSource: &texttospeechpb.SynthesisInput_Text{Text: text},
 			},
-			// Build the voice request, select the language code ("en-US") and the SSML
-			// voice gender ("neutral").
-			Voice: &texttospeechpb.VoiceSelectionParams{
-				LanguageCode: lang,
-				SsmlGender:   texttospeechpb.SsmlVoiceGender_NEUTRAL,
-			},
-			// Select the type of audio file you want returned.
+			Voice: voiceSelectionParams(voice),
 			AudioConfig: &texttospeechpb.AudioConfig{
-				AudioEncoding: texttospeechpb.AudioEncoding_MP3,
+				AudioEncoding: encoding,
+				SpeakingRate:  voice.SpeakingRate,
+				Pitch:         voice.Pitch,
 			},
 		}
 
@@ -201,13 +953,12 @@ func startSpeaking(texts chan string, lang string) {
 			log.Fatal(err)
 		}
 
-		// The resp's AudioContent is binary.
-		filename := "output.mp3"
-		err = ioutil.WriteFile(filename, resp.AudioContent, 0644)
-		if err != nil {
-			log.Fatal(err)
+		if err := cache.put(text, voice, encoding, resp.AudioContent); err != nil {
+			log.Printf("Could not cache synthesized audio: %v", err)
+		}
+		if err := sink.Write(resp.AudioContent); err != nil {
+			log.Printf("Could not write synthesized audio: %v", err)
 		}
-		fmt.Printf("Audio content written to file: %v\n", filename)
 	}
 
 }